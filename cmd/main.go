@@ -1,11 +1,20 @@
 package main
 
 import (
+	"context"
 	"flag"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 	mpi "github.com/sbromberger/gompi"
 	"os"
+	"pchpc_next/scenario"
 	"pchpc_next/streets"
 	"strconv"
 	"sync"
@@ -20,206 +29,581 @@ func main() {
 	jsonPath := flag.String("jsonPath", "assets/out.json", "Path to the json containing the graph data")
 	debug := flag.Bool("debug", false, "Enable debug mode")
 	useMPI := flag.Bool("mpi", false, "Use MPI")
+	metricsAddr := flag.String("metrics-addr", "", "Address to serve Prometheus metrics on (rank 0 only); empty disables the endpoint")
+	mpiBatchSize := flag.Int("mpi-batch-size", streets.DefaultMPIBatchSize, "Number of vehicles to batch per MPI transfer message")
+	mpiBatchTimeout := flag.Duration("mpi-batch-timeout", streets.DefaultMPIBatchTimeout, "Maximum time a vehicle waits in a transfer batch before it is flushed")
+	rebalanceInterval := flag.Duration("rebalance-interval", 2*time.Second, "How often leaves report their load and root checks for a rebalance")
+	noRebalance := flag.Bool("no-rebalance", false, "Disable dynamic leaf rebalancing")
+	seed := flag.Int64("seed", time.Now().UnixNano(), "RNG seed for vehicle placement, recorded in snapshots for deterministic replay")
+	snapshotIn := flag.String("snapshot-in", "", "Path to a snapshot to resume vehicles and leaf lookup from; empty starts a fresh run")
+	snapshotOut := flag.String("snapshot-out", "", "Path to periodically write simulation snapshots to; empty disables snapshotting")
+	snapshotInterval := flag.Duration("snapshot-interval", 30*time.Second, "How often to write a snapshot when -snapshot-out is set")
 
 	flag.Parse()
 
 	setupLogging(debug)
 
-	b := streets.NewGraphBuilder().FromJsonFile(*jsonPath).SetTopRightBottomLeftVertices()
-	rootGraph, err := b.NumberOfRects(1).DivideGraphsIntoRects().PickRect(0).IsRoot().Build()
-	if err != nil {
-		log.Error().Err(err).Msg("Failed to build graph")
-		return
+	sim := &simState{
+		n:                 n,
+		minSpeed:          minSpeed,
+		maxSpeed:          maxSpeed,
+		jsonPath:          jsonPath,
+		metricsAddr:       metricsAddr,
+		mpiBatchSize:      mpiBatchSize,
+		mpiBatchTimeout:   mpiBatchTimeout,
+		rebalanceInterval: rebalanceInterval,
+		noRebalance:       noRebalance,
+		seed:              seed,
+		snapshotIn:        snapshotIn,
+		snapshotOut:       snapshotOut,
+		snapshotInterval:  snapshotInterval,
 	}
 
-	// Create vehicles and drive
-	ns := strconv.Itoa(*n)
-	log.Info().Msg("Starting vehicles " + ns)
+	steps := []scenario.Step{
+		scenario.FuncStep{StepName: "build-root", Fn: sim.buildRoot},
+		scenario.FuncStep{StepName: "connect-vehicles", StepRequires: []string{"build-root"}, Fn: sim.connectVehicles},
+	}
 
-	vehicleList := make([]*streets.Vehicle, *n)
+	if *useMPI {
+		mpiToken, err := mpi.Start()
+		if err != nil {
+			log.Error().Err(err).Msg("Failed to start MPI")
+			return
+		}
+		defer mpiToken.Stop()
+		comm := mpiToken.NewCommunicator(nil)
+		sim.taskID = comm.Rank()
+		sim.comm = comm
+		sim.worldSize = mpiToken.WorldSize()
+
+		if sim.worldSize < 2 {
+			log.Error().Msg("World size is less than 2")
+			return
+		}
+		sim.rectangularSplits = sim.worldSize - 1
+
+		steps = append(steps,
+			scenario.FuncStep{StepName: "build-leaves", StepRequires: []string{"build-root"}, Fn: sim.buildLeaves},
+			scenario.FuncStep{StepName: "emit-vehicles", StepRequires: []string{"build-leaves", "connect-vehicles"}, Fn: sim.emitVehicles},
+			scenario.FuncStep{StepName: "spawn-listeners", StepRequires: []string{"emit-vehicles"}, Fn: sim.spawnListeners},
+			scenario.FuncStep{StepName: "run-leaves", StepRequires: []string{"build-leaves"}, Fn: sim.runLeaves},
+		)
+	}
 
-	if connectVehiclesToGraph(n, rootGraph, minSpeed, maxSpeed, vehicleList) {
-		log.Error().Err(err).Msg("Failed to add vehicle")
+	if err := scenario.NewRunner(steps...).Run(context.Background()); err != nil {
+		log.Error().Err(err).Msg("Scenario run failed")
 		return
 	}
 
 	if !*useMPI {
 		log.Info().Msg("Running without MPI")
+		startMetricsServer(metricsAddr)
 		if *useRoutines {
-			runWithGoRoutines(vehicleList)
+			runWithGoRoutines(sim.vehicleList)
 		} else {
-			runSequentially(vehicleList)
+			runSequentially(sim.vehicleList)
 		}
-		return
 	}
+}
+
+// simState carries the mutable state built up across the scenario DAG's
+// steps (build-root, build-leaves, connect-vehicles, emit-vehicles,
+// spawn-listeners, run-leaves), since a scenario.Step's Run only returns an
+// error.
+type simState struct {
+	n           *int
+	minSpeed    *float64
+	maxSpeed    *float64
+	jsonPath    *string
+	metricsAddr *string
+
+	mpiBatchSize      *int
+	mpiBatchTimeout   *time.Duration
+	rebalanceInterval *time.Duration
+	noRebalance       *bool
+
+	seed             *int64
+	snapshotIn       *string
+	snapshotOut      *string
+	snapshotInterval *time.Duration
+
+	taskID            int
+	worldSize         int
+	comm              *mpi.Communicator
+	rectangularSplits int
+
+	rootGraph      *streets.StreetGraph
+	vehicleList    []*streets.Vehicle
+	restoredLeafOf map[int]int
+
+	leafList   []*streets.StreetGraph
+	leafLookup *streets.LeafLookup
+	m          *streets.MPI
+}
+
+// buildRoot loads and builds the unpartitioned root graph every rank works
+// from.
+func (s *simState) buildRoot(_ context.Context) error {
+	b := streets.NewGraphBuilder().FromJsonFile(*s.jsonPath).SetTopRightBottomLeftVertices()
+	rootGraph, err := b.NumberOfRects(1).DivideGraphsIntoRects().PickRect(0).IsRoot().Build()
+	if err != nil {
+		return fmt.Errorf("build graph: %w", err)
+	}
+	s.rootGraph = rootGraph
+	return nil
+}
 
-	mpi.Start(false)
-	defer mpi.Stop()
-	comm := mpi.NewCommunicator(nil)
+// connectVehicles creates this rank's vehicle list, attached to rootGraph.
+// In MPI mode only rank 0's list is ever emitted; the others are built the
+// same way regardless, matching the rest of this rank's setup. If
+// -snapshot-in is set, the vehicle list is restored from it instead of
+// picked at random, and math/rand is re-seeded from the snapshot's recorded
+// seed rather than -seed. That is the seed the original run started with, so
+// the random sequence restarts from that run's beginning; the generator's
+// position at the time the snapshot was written is not restored.
+func (s *simState) connectVehicles(_ context.Context) error {
+	if *s.snapshotIn != "" {
+		vehicles, leafOf, err := streets.Restore(*s.snapshotIn)
+		if err != nil {
+			return fmt.Errorf("restore snapshot: %w", err)
+		}
+		restoredSeed, err := streets.RestoreSeed(*s.snapshotIn)
+		if err != nil {
+			return fmt.Errorf("restore snapshot seed: %w", err)
+		}
+		rand.Seed(restoredSeed)
+		for _, v := range vehicles {
+			v.StreetGraph = s.rootGraph
+		}
+		s.vehicleList = vehicles
+		s.restoredLeafOf = leafOf
+		log.Info().Msgf("Restored %d vehicles from snapshot %s (seed %d)", len(vehicles), *s.snapshotIn, restoredSeed)
+		return nil
+	}
 
-	//numTasks := world.Size()
-	taskID := comm.Rank()
+	rand.Seed(*s.seed)
+	ns := strconv.Itoa(*s.n)
+	log.Info().Msg("Starting vehicles " + ns)
 
-	if mpi.WorldSize() < 2 {
-		log.Error().Msg("World size is less than 2")
-		return
+	vehicleList := make([]*streets.Vehicle, *s.n)
+	if connectVehiclesToGraph(s.n, s.rootGraph, s.minSpeed, s.maxSpeed, vehicleList) {
+		return fmt.Errorf("failed to add vehicle")
 	}
+	s.vehicleList = vehicleList
+	return nil
+}
 
-	// I.3 every process will divide the graph into rectangles
-	rectangularSplits := mpi.WorldSize() - 1
+// buildLeaves divides the root graph into rectangles and builds every
+// leaf's partition, plus the LeafLookup routing table and this rank's MPI
+// helper. Every rank does this the same way, not just root.
+func (s *simState) buildLeaves(_ context.Context) error {
 	leafList := make([]*streets.StreetGraph, 0)
-	for rank := 0; rank <= rectangularSplits; rank++ {
+	for rank := 0; rank <= s.rectangularSplits; rank++ {
 		if rank == 0 {
 			continue
 		}
-		log.Debug().Msgf("[%d] Setting up leaf (WorldSize: %d)", taskID, mpi.WorldSize())
-		// rank means taskID
-		l, err := setupLeaf(jsonPath, rootGraph, rectangularSplits, rank, rank)
+		log.Debug().Msgf("[%d] Setting up leaf (WorldSize: %d)", s.taskID, s.worldSize)
+		l, err := setupLeaf(s.jsonPath, s.rootGraph, s.rectangularSplits, rank, rank)
 		if err != nil {
-			log.Error().Msgf("[%d] Failed to setup leaf", taskID)
-			return
+			return fmt.Errorf("setup leaf %d: %w", rank, err)
 		}
 		leafList = append(leafList, l)
 	}
+	s.leafList = leafList
+	log.Info().Msgf("[%d] Leaf list length: %d", s.taskID, len(leafList))
 
-	log.Info().Msgf("[%d] Leaf list length: %d", taskID, len(leafList))
-
-	var leafLookup = make(map[int]int) // [vertexID] => leafID
-	edges, err := rootGraph.Graph.Edges()
+	leafLookup := streets.NewLeafLookup() // [vertexID] => leafID
+	edges, err := s.rootGraph.Graph.Edges()
 	if err != nil {
-		log.Error().Err(err).Msg("Failed to get edges")
-		return
+		return fmt.Errorf("get edges: %w", err)
 	}
-
 	for _, graph := range leafList {
 		for _, edge := range edges {
-			src := edge.Source
-			dest := edge.Target
-			if graph.VertexExists(src) {
-				leafLookup[src] = graph.ID
+			if graph.VertexExists(edge.Source) {
+				leafLookup.Set(edge.Source, graph.ID)
 			}
-			if graph.VertexExists(dest) {
-				leafLookup[dest] = graph.ID
+			if graph.VertexExists(edge.Target) {
+				leafLookup.Set(edge.Target, graph.ID)
 			}
 		}
 	}
+	// A restored leaf lookup (e.g. one a prior run had already rebalanced)
+	// takes precedence over the fresh geometry-based assignment above.
+	for vertexID, leafID := range s.restoredLeafOf {
+		leafLookup.Set(vertexID, leafID)
+	}
+	s.leafLookup = leafLookup
 
-	log.Debug().Msgf("[%d] Leaf lookup: %d->%v", taskID, 28095826, leafLookup[28095826])
+	s.m = streets.NewMPI(s.taskID, *s.comm, s.rootGraph, s.worldSize)
+	s.m.SetBatchOptions(*s.mpiBatchSize, *s.mpiBatchTimeout)
+	return nil
+}
 
-	if taskID == 0 {
-		size, err := rootGraph.Graph.Size()
-		if err != nil {
-			log.Error().Err(err).Msg("Failed to get size of graph")
-			return
+// emitVehicles, on rank 0 only, starts the metrics server and batches the
+// initial vehicle list out to the leaves that own their starting vertices.
+// Other ranks have nothing to emit.
+func (s *simState) emitVehicles(_ context.Context) error {
+	if s.taskID != 0 {
+		return nil
+	}
+
+	startMetricsServer(s.metricsAddr)
+
+	size, err := s.rootGraph.Graph.Size()
+	if err != nil {
+		return fmt.Errorf("get size of graph: %w", err)
+	}
+	log.Info().Msgf("Number of vertices: %d", size)
+
+	initial := make([]streets.Vehicle, len(s.vehicleList))
+	for i, vehicle := range s.vehicleList {
+		initial[i] = *vehicle
+	}
+	if err := s.m.EmitVehicles(initial, s.leafLookup); err != nil {
+		return fmt.Errorf("emit vehicles: %w", err)
+	}
+	return nil
+}
+
+// spawnListeners, on rank 0 only, demultiplexes every incoming MPI message
+// through a single Dispatcher and blocks until all vehicles have parked and
+// Shutdown has been broadcast. Other ranks have no listener of their own;
+// they're served by run-leaves instead.
+func (s *simState) spawnListeners(_ context.Context) error {
+	if s.taskID != 0 {
+		return nil
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var parked int64
+	// expectedVehicles is len(s.vehicleList), not *s.n: -snapshot-in restores
+	// a vehicle list of whatever size the snapshot recorded, without
+	// updating *s.n, so comparing against the flag would hang forever
+	// (restored more than -n) or broadcast shutdown too early (restored
+	// fewer).
+	expectedVehicles := int64(len(s.vehicleList))
+	d := streets.NewDispatcher(s.m, 4)
+	d.Handle(streets.MessageKindEdgeLengthReq, func(_ context.Context, payload interface{}) error {
+		return s.m.RespondToEdgeLength(payload.(streets.EdgeLengthRequest))
+	})
+	d.Handle(streets.MessageKindVehicleTransfer, func(_ context.Context, payload interface{}) error {
+		return s.m.ForwardVehicle(payload.(streets.Vehicle), s.leafLookup)
+	})
+	d.Handle(streets.MessageKindVehicleBatch, func(_ context.Context, payload interface{}) error {
+		return s.m.ForwardVehicles(payload.([]streets.Vehicle), s.leafLookup)
+	})
+	d.Handle(streets.MessageKindVehicleAck, func(_ context.Context, _ interface{}) error {
+		if atomic.AddInt64(&parked, 1) >= expectedVehicles {
+			log.Info().Msg("All vehicles parked, broadcasting shutdown")
+			d.BroadcastShutdown()
+			cancel()
 		}
-		log.Info().Msgf("Number of vertices: %d", size)
-		m := streets.NewMPI(0, *comm, rootGraph)
+		return nil
+	})
+
+	if !*s.noRebalance {
+		rebalancer := streets.NewRebalancer(streets.DefaultRebalanceRatio)
+		d.Handle(streets.MessageKindLoadReport, func(_ context.Context, payload interface{}) error {
+			rebalancer.Report(payload.(streets.LoadReport))
+			return nil
+		})
+
+		go func() {
+			ticker := time.NewTicker(*s.rebalanceInterval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-ticker.C:
+					r, ok := rebalancer.Plan(s.rootGraph, s.leafLookup)
+					if !ok {
+						continue
+					}
+					log.Info().Msgf("Rebalancing: moving %d vertices from leaf %d to leaf %d", len(r.VertexIDs), r.FromLeaf, r.ToLeaf)
+					s.leafLookup.Reassign(r)
+					s.m.BroadcastEdgeReassignment(r)
+				}
+			}
+		}()
+	}
 
-		// I.4 root process will emit vehicles initially
-		for _, vehicle := range vehicleList {
-			err = m.EmitVehicle(*vehicle, leafLookup)
-			if err != nil {
-				log.Error().Err(err).Msg("Failed to emit vehicle")
-				return
+	if *s.snapshotOut != "" {
+		collector := newSnapshotCollector()
+		d.Handle(streets.MessageKindSnapshotVehicles, collector.handle)
+
+		go func() {
+			ticker := time.NewTicker(*s.snapshotInterval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-ticker.C:
+					wait := collector.startRound(s.rectangularSplits)
+					s.m.BroadcastSnapshotRequest()
+
+					select {
+					case <-wait:
+					case <-ctx.Done():
+						return
+					}
+					s.m.AwaitSnapshotBarrier()
+
+					vehicles := collector.vehicles()
+					// Drop each vehicle's live StreetGraph before encoding: it's the
+					// whole leaf graph it was driving on, and connectVehicles
+					// overwrites it unconditionally on restore, so none of that
+					// would ever be read back.
+					for i := range vehicles {
+						vehicles[i].StreetGraph = nil
+					}
+					leafOf := s.leafLookup.Snapshot()
+					if err := streets.WriteSnapshot(*s.snapshotOut, vehicles, leafOf, *s.seed); err != nil {
+						log.Error().Err(err).Msg("Failed to write snapshot")
+						continue
+					}
+					log.Info().Msgf("Wrote snapshot to %s (%d vehicles)", *s.snapshotOut, len(vehicles))
+				}
 			}
+		}()
+	}
+
+	log.Info().Msgf("[%d] Serving MPI dispatcher", s.taskID)
+	if err := d.Serve(ctx); err != nil && err != context.Canceled {
+		return fmt.Errorf("dispatcher stopped: %w", err)
+	}
+	return nil
+}
+
+// snapshotCollector gathers each leaf's SnapshotVehicles reply into one
+// round on root, closing done once every leaf expected this round has
+// reported in. It's registered as the MessageKindSnapshotVehicles Handler
+// rather than read with a direct blocking Recv, since the Dispatcher's own
+// probe loop is already consuming every incoming message.
+type snapshotCollector struct {
+	mu        sync.Mutex
+	remaining int
+	collected []streets.Vehicle
+	done      chan struct{}
+}
+
+func newSnapshotCollector() *snapshotCollector {
+	return &snapshotCollector{}
+}
+
+// startRound resets the collector for a new snapshot round expecting a
+// reply from expected leaves, and returns the channel that closes once
+// they've all reported in.
+func (c *snapshotCollector) startRound(expected int) <-chan struct{} {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.remaining = expected
+	c.collected = nil
+	c.done = make(chan struct{})
+	if expected == 0 {
+		close(c.done)
+	}
+	return c.done
+}
+
+func (c *snapshotCollector) handle(_ context.Context, payload interface{}) error {
+	batch, ok := payload.([]streets.Vehicle)
+	if !ok {
+		return fmt.Errorf("snapshot collector: unexpected payload type %T", payload)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.collected = append(c.collected, batch...)
+	c.remaining--
+	if c.remaining <= 0 && c.done != nil {
+		select {
+		case <-c.done:
+		default:
+			close(c.done)
 		}
+	}
+	return nil
+}
 
-		// I.5 root process will listen for incoming requests
-		var wg sync.WaitGroup
+// vehicles returns the vehicles collected during the most recently
+// completed round.
+func (c *snapshotCollector) vehicles() []streets.Vehicle {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	out := make([]streets.Vehicle, len(c.collected))
+	copy(out, c.collected)
+	return out
+}
 
-		wg.Add(1)
-		go func(wg *sync.WaitGroup) {
-			defer wg.Done()
-			err, done := ListenForLengthRequest(err, m)
-			if err != nil {
-				log.Error().Err(err).Msg("Failed to listen for length request")
-				return
-			}
-			if done {
-				return
-			}
-		}(&wg) // TODO: add done channel?
-		// TODO: check if parameter is correct or if it should be a pointer
-		log.Info().Msgf("[%d] Waiting for length request", taskID)
+// runLeaves, on every rank but 0, receives vehicles transferred to this
+// leaf and drives them until root broadcasts Shutdown. Rank 0 has nothing
+// to do here; it's served by spawn-listeners instead.
+func (s *simState) runLeaves(_ context.Context) error {
+	if s.taskID == 0 {
+		return nil
+	}
 
-		wg.Add(1)
-		go func(wg *sync.WaitGroup) {
-			defer wg.Done()
-			if ListenForReceiveAndSendRequest(err, m, leafLookup) {
-				return
+	log.Info().Msgf("[%d] Starting leaf", s.taskID)
+	leaf := s.leafList[s.taskID-1]
+	size, err := leaf.Graph.Size()
+	if err != nil {
+		return fmt.Errorf("[%d] get size of graph: %w", s.taskID, err)
+	}
+	log.Info().Msgf("[%d] Starting leaf size: %d", s.taskID, size)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var vehicleCount int64
+	var load leafLoad
+	registry := newVehicleRegistry()
+	s.m.SetSnapshotProvider(registry.snapshot)
+	if !*s.noRebalance {
+		go func() {
+			ticker := time.NewTicker(*s.rebalanceInterval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-ticker.C:
+					if err := s.m.SendLoadReport(streets.LoadReport{
+						LeafID:       s.taskID,
+						VehicleCount: int(atomic.LoadInt64(&vehicleCount)),
+						AvgStepTime:  load.average(),
+					}); err != nil {
+						log.Error().Err(err).Msgf("[%d] Failed to send load report", s.taskID)
+					}
+				}
 			}
-		}(&wg)
-		// TODO: check if parameter is correct or if it should be a pointer
-		log.Info().Msgf("[%d] Waiting for receive and send request", taskID)
-
-		wg.Wait()
-	} else {
-		log.Info().Msgf("[%d] Starting leaf", taskID)
-		m := streets.NewMPI(taskID, *comm, rootGraph)
-		leaf := leafList[taskID-1]
-		size, err := leaf.Graph.Size()
+		}()
+	}
+
+	var wg sync.WaitGroup
+	for {
+		vehicleOnLeaf, shutdown, err := s.m.ReceiveVehicleOnLeaf(leaf, s.leafLookup) // II.1 & II.2
 		if err != nil {
-			log.Error().Err(err).Msgf("[%d] Failed to get size of graph", taskID)
-			return
+			return fmt.Errorf("[%d] receive vehicle on leaf: %w", s.taskID, err)
+		}
+		if shutdown {
+			log.Info().Msgf("[%d] Received shutdown, waiting for in-flight vehicles", s.taskID)
+			cancel()
+			wg.Wait()
+			return nil
 		}
-		log.Info().Msgf("[%d] Starting leaf size: %d", taskID, size)
+		vehicleOnLeaf.MarkedForDeletion = false // II.3
 
-		for {
-			vehicleOnLeaf, err := m.ReceiveVehicleOnLeaf() // II.1 & II.2
-			if err != nil {
-				log.Error().Err(err).Msgf("[%d] Failed to receive vehicle on leaf", taskID)
-				return
-			}
-			vehicleOnLeaf.MarkedForDeletion = false // II.3
+		length, err := s.m.AskRootForEdgeLength(vehicleOnLeaf.PrevID, vehicleOnLeaf.NextID) // II.4
+		if err != nil {
+			return fmt.Errorf("[%d] ask root for edge length: %w", s.taskID, err)
+		}
+		vehicleOnLeaf.Delta += length // II.5
 
-			length, err := m.AskRootForEdgeLength(vehicleOnLeaf.PrevID, vehicleOnLeaf.NextID) // II.4
-			if err != nil {
-				log.Error().Err(err).Msgf("[%d] Failed to ask root for edge length", taskID)
-				return
+		if vehicleOnLeaf.Delta > streets.CongestionReplanThreshold {
+			if err := vehicleOnLeaf.Replan(s.rootGraph); err != nil {
+				log.Debug().Err(err).Msgf("[%d] Failed to replan congested vehicle %s", s.taskID, vehicleOnLeaf.ID)
 			}
-			vehicleOnLeaf.Delta += length // II.5
-
-			// TODO: add previous edge length?
-			go driveVehicle(vehicleOnLeaf, leaf, taskID, m)
 		}
 
+		streets.VehiclesPerLeaf.WithLabelValues(strconv.Itoa(s.taskID)).Inc()
+		atomic.AddInt64(&vehicleCount, 1)
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer atomic.AddInt64(&vehicleCount, -1)
+			driveVehicle(vehicleOnLeaf, leaf, s.taskID, s.m, &load, registry)
+		}()
 	}
 }
 
-func ListenForReceiveAndSendRequest(err error, m *streets.MPI, lookupTable map[int]int) bool {
-	for {
-		// I.5.b root process will listen for incoming vehicles and send them to the leaf
-		err = m.ReceiveAndSendVehicleOverRoot(lookupTable)
-		if err != nil {
-			log.Error().Err(err).Msg("Failed to receive vehicle on root from leaf")
-			return true
-		}
+// vehicleRegistry tracks the vehicles currently in flight on a leaf, so a
+// SnapshotRequest arriving mid-drive has something to report back to root.
+type vehicleRegistry struct {
+	mu       sync.Mutex
+	vehicles map[string]streets.Vehicle
+}
+
+func newVehicleRegistry() *vehicleRegistry {
+	return &vehicleRegistry{vehicles: make(map[string]streets.Vehicle)}
+}
+
+func (r *vehicleRegistry) set(v streets.Vehicle) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.vehicles[v.ID] = v
+}
+
+func (r *vehicleRegistry) delete(id string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.vehicles, id)
+}
+
+// snapshot returns a copy of every vehicle currently registered, safe to
+// hand to MPI.SetSnapshotProvider.
+func (r *vehicleRegistry) snapshot() []streets.Vehicle {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	out := make([]streets.Vehicle, 0, len(r.vehicles))
+	for _, v := range r.vehicles {
+		out = append(out, v)
 	}
+	return out
 }
 
-func ListenForLengthRequest(err error, m *streets.MPI) (error, bool) {
-	for {
-		// I.5.a root process will listen for incoming requests for edge length
-		// TODO: make async
-		err = m.RespondToEdgeLengthRequest()
-		if err != nil {
-			log.Error().Err(err).Msg("Failed to respond to edge length request")
-			return nil, true
-		}
+// leafLoad tracks the EWMA average time a vehicle's Step takes on this leaf,
+// reported to root alongside the vehicle count in each LoadReport. The
+// Rebalancer's load tracking uses only the vehicle count; it does not read
+// the step time.
+type leafLoad struct {
+	mu    sync.Mutex
+	alpha float64
+	ewma  float64
+	set   bool
+}
+
+func (l *leafLoad) observe(d time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.alpha == 0 {
+		l.alpha = 0.3
+	}
+	seconds := d.Seconds()
+	if !l.set {
+		l.ewma, l.set = seconds, true
+		return
 	}
-	return err, false
+	l.ewma = l.alpha*seconds + (1-l.alpha)*l.ewma
+}
+
+func (l *leafLoad) average() float64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.ewma
 }
 
-func driveVehicle(vehicleOnLeaf streets.Vehicle, l *streets.StreetGraph, taskID int, m *streets.MPI) bool {
+func driveVehicle(vehicleOnLeaf streets.Vehicle, l *streets.StreetGraph, taskID int, m *streets.MPI, load *leafLoad, registry *vehicleRegistry) bool {
+	defer streets.VehiclesPerLeaf.WithLabelValues(strconv.Itoa(taskID)).Dec()
+
 	vehicleOnLeaf.StreetGraph = l // II.5.1
 
 	// update nodes after graph transition II.5.2 -> shift the array
 	vehicleOnLeaf.PrevID = vehicleOnLeaf.GetNextID(vehicleOnLeaf.PrevID)
 	vehicleOnLeaf.NextID = vehicleOnLeaf.GetNextID(vehicleOnLeaf.PrevID)
+	registry.set(vehicleOnLeaf)
+	defer registry.delete(vehicleOnLeaf.ID)
 
 	for {
 		if vehicleOnLeaf.IsParked { // II.7.1
 			log.Info().Msgf("[%d] Vehicle %s is parked", taskID, vehicleOnLeaf.ID) // II.10
+			if err := m.AckVehicleParked(vehicleOnLeaf.ID); err != nil {
+				log.Error().Err(err).Msgf("[%d] Failed to ack parked vehicle", taskID)
+			}
 			break
 		} else if vehicleOnLeaf.MarkedForDeletion { // II.7.2
 			log.Debug().Msgf("[%d] Vehicle %s is marked for deletion", taskID, vehicleOnLeaf.ID)
@@ -230,7 +614,10 @@ func driveVehicle(vehicleOnLeaf streets.Vehicle, l *streets.StreetGraph, taskID
 			}
 			break
 		}
+		start := time.Now()
 		vehicleOnLeaf.Step() // II.8
+		load.observe(time.Since(start))
+		registry.set(vehicleOnLeaf)
 	}
 	return false
 }
@@ -238,8 +625,7 @@ func driveVehicle(vehicleOnLeaf streets.Vehicle, l *streets.StreetGraph, taskID
 func setupLeaf(jsonPath *string, rootGraph *streets.StreetGraph, rectangularSplits int, i int, taskID int) (*streets.StreetGraph, error) {
 	log.Debug().Msgf("[%d] i=%d", taskID, i)
 	gb := streets.NewGraphBuilder().FromJsonFile(*jsonPath).IsLeaf(rootGraph, taskID).NumberOfRects(rectangularSplits)
-	gb = gb.PickRect(i - 1).DivideGraphsIntoRects().FilterForRect()
-	gb = gb.SetTopRightBottomLeftVertices()
+	gb = gb.SetTopRightBottomLeftVertices().PickRect(i - 1).DivideGraphsIntoRects().FilterForRect()
 	leafGraph, err := gb.Build()
 	if err != nil {
 		log.Error().Err(err).Msg("Failed to build graph")
@@ -283,6 +669,21 @@ func connectVehiclesToGraph(n *int, rootGraph *streets.StreetGraph, minSpeed *fl
 	return false
 }
 
+func startMetricsServer(addr *string) {
+	if *addr == "" {
+		return
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	go func() {
+		log.Info().Msgf("Serving Prometheus metrics on %s", *addr)
+		if err := http.ListenAndServe(*addr, mux); err != nil {
+			log.Error().Err(err).Msg("Metrics server stopped")
+		}
+	}()
+}
+
 func setupLogging(debug *bool) {
 	// Logging
 	log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stderr})
@@ -0,0 +1,78 @@
+package streets
+
+import (
+	"sync"
+	"time"
+)
+
+// Defaults for TransferBuffer, overridable via MPI.SetBatchOptions (and, in
+// main, the -mpi-batch-size / -mpi-batch-timeout flags).
+const (
+	DefaultMPIBatchSize    = 64
+	DefaultMPIBatchTimeout = 5 * time.Millisecond
+)
+
+// TransferBuffer accumulates vehicles bound for one destination rank and
+// flushes them as a single batch, either once it reaches batchSize or once
+// timeout has elapsed since the oldest unflushed vehicle was added —
+// whichever happens first. This amortizes MPI's well-known fixed
+// per-message overhead across many vehicles instead of paying it per
+// vehicle.
+type TransferBuffer struct {
+	mu        sync.Mutex
+	dest      int
+	batchSize int
+	timeout   time.Duration
+	vehicles  []Vehicle
+	timer     *time.Timer
+	flush     func(dest int, batch []Vehicle)
+}
+
+// NewTransferBuffer returns a TransferBuffer for dest that calls flush
+// whenever it drains, either because it filled up or because its deadline
+// passed.
+func NewTransferBuffer(dest, batchSize int, timeout time.Duration, flush func(dest int, batch []Vehicle)) *TransferBuffer {
+	return &TransferBuffer{
+		dest:      dest,
+		batchSize: batchSize,
+		timeout:   timeout,
+		flush:     flush,
+	}
+}
+
+// Add appends v to the buffer, starting the flush deadline if this is the
+// first vehicle since the last flush, and flushing immediately if the
+// buffer just reached batchSize.
+func (b *TransferBuffer) Add(v Vehicle) {
+	b.mu.Lock()
+	b.vehicles = append(b.vehicles, v)
+	if b.timer == nil {
+		b.timer = time.AfterFunc(b.timeout, b.Flush)
+	}
+	full := len(b.vehicles) >= b.batchSize
+	b.mu.Unlock()
+
+	if full {
+		b.Flush()
+	}
+}
+
+// Flush sends whatever is currently buffered, if anything, and resets the
+// deadline. Safe to call concurrently with Add and with itself (e.g. from
+// both the size threshold and the deadline timer).
+func (b *TransferBuffer) Flush() {
+	b.mu.Lock()
+	if len(b.vehicles) == 0 {
+		b.mu.Unlock()
+		return
+	}
+	batch := b.vehicles
+	b.vehicles = nil
+	if b.timer != nil {
+		b.timer.Stop()
+		b.timer = nil
+	}
+	b.mu.Unlock()
+
+	b.flush(b.dest, batch)
+}
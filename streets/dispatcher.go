@@ -0,0 +1,223 @@
+package streets
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	mpi "github.com/sbromberger/gompi"
+)
+
+// MessageKind identifies the shape of the payload on an MPI message so a
+// single Serve loop can demultiplex onto the right Handler instead of each
+// caller blocking on one specific tag.
+type MessageKind int
+
+const (
+	MessageKindEdgeLengthReq MessageKind = iota
+	MessageKindEdgeLengthResp
+	MessageKindVehicleTransfer
+	MessageKindVehicleBatch
+	MessageKindVehicleAck
+	MessageKindLoadReport
+	MessageKindEdgeReassignment
+	MessageKindSnapshotRequest
+	MessageKindSnapshotVehicles
+	MessageKindShutdown
+)
+
+func (k MessageKind) String() string {
+	switch k {
+	case MessageKindEdgeLengthReq:
+		return "EdgeLengthReq"
+	case MessageKindEdgeLengthResp:
+		return "EdgeLengthResp"
+	case MessageKindVehicleTransfer:
+		return "VehicleTransfer"
+	case MessageKindVehicleBatch:
+		return "VehicleBatch"
+	case MessageKindVehicleAck:
+		return "VehicleAck"
+	case MessageKindLoadReport:
+		return "LoadReport"
+	case MessageKindEdgeReassignment:
+		return "EdgeReassignment"
+	case MessageKindSnapshotRequest:
+		return "SnapshotRequest"
+	case MessageKindSnapshotVehicles:
+		return "SnapshotVehicles"
+	case MessageKindShutdown:
+		return "Shutdown"
+	default:
+		return fmt.Sprintf("MessageKind(%d)", int(k))
+	}
+}
+
+// Handler processes one received message's payload. Handlers run on the
+// Dispatcher's worker pool, not on the Serve goroutine, so a slow handler
+// (e.g. one doing a blocking send back to a leaf) doesn't stall the probe
+// loop.
+type Handler func(ctx context.Context, payload interface{}) error
+
+type job struct {
+	kind    MessageKind
+	payload interface{}
+}
+
+// Dispatcher demultiplexes incoming MPI messages by MessageKind onto a
+// registry of Handlers, replacing the old pattern of one goroutine blocked
+// on one tag per message kind.
+type Dispatcher struct {
+	m        *MPI
+	handlers map[MessageKind]Handler
+	jobs     chan job
+	workers  int
+}
+
+// NewDispatcher returns a Dispatcher that reads messages via m and fans
+// them out across workers goroutines.
+func NewDispatcher(m *MPI, workers int) *Dispatcher {
+	if workers < 1 {
+		workers = 1
+	}
+	return &Dispatcher{
+		m:        m,
+		handlers: make(map[MessageKind]Handler),
+		jobs:     make(chan job, workers*4),
+		workers:  workers,
+	}
+}
+
+// Handle registers h to process every message of the given kind.
+func (d *Dispatcher) Handle(kind MessageKind, h Handler) {
+	d.handlers[kind] = h
+}
+
+// Serve runs the probe loop until ctx is cancelled or a Shutdown message is
+// received. It uses Iprobe so the loop can also observe ctx.Done() between
+// polls instead of blocking forever inside a single Recv, which is what
+// made the old listener goroutines impossible to stop cleanly.
+func (d *Dispatcher) Serve(ctx context.Context) error {
+	var wg sync.WaitGroup
+	for i := 0; i < d.workers; i++ {
+		wg.Add(1)
+		go d.worker(ctx, &wg)
+	}
+
+	defer func() {
+		close(d.jobs)
+		wg.Wait()
+	}()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+		}
+
+		kind, payload, ok, err := d.m.probeAndRecv()
+		if err != nil {
+			return err
+		}
+		if !ok {
+			time.Sleep(time.Millisecond)
+			continue
+		}
+
+		if kind == MessageKindShutdown {
+			return nil
+		}
+
+		ListenerQueueDepth.WithLabelValues("dispatcher").Inc()
+		d.jobs <- job{kind: kind, payload: payload}
+	}
+}
+
+func (d *Dispatcher) worker(ctx context.Context, wg *sync.WaitGroup) {
+	defer wg.Done()
+	for j := range d.jobs {
+		ListenerQueueDepth.WithLabelValues("dispatcher").Dec()
+		h, ok := d.handlers[j.kind]
+		if !ok {
+			continue
+		}
+		if err := h(ctx, j.payload); err != nil {
+			MPIMessagesTotal.WithLabelValues(j.kind.String() + "_error").Inc()
+		}
+	}
+}
+
+// BroadcastShutdown sends a Shutdown message to every other rank so their
+// Serve/receive loops can return instead of blocking forever once the
+// simulation has parked all vehicles.
+func (d *Dispatcher) BroadcastShutdown() {
+	d.m.FlushAll()
+	d.m.broadcastShutdown()
+}
+
+// probeAndRecv checks for one pending message from any rank and, if one is
+// waiting, receives and decodes it.
+func (m *MPI) probeAndRecv() (MessageKind, interface{}, bool, error) {
+	available, source, tag := m.comm.iprobe(mpi.AnySource, mpi.AnyTag)
+	if !available {
+		return 0, nil, false, nil
+	}
+
+	kind := MessageKind(tag)
+
+	switch kind {
+	case MessageKindEdgeLengthReq:
+		var req EdgeLengthRequest
+		if err := m.recvGob(&req, source, int(kind)); err != nil {
+			return kind, nil, true, fmt.Errorf("streets: malformed edge length request: %w", err)
+		}
+		return kind, req, true, nil
+	case MessageKindVehicleTransfer:
+		var v Vehicle
+		if err := m.recvGob(&v, source, int(kind)); err != nil {
+			return kind, nil, true, fmt.Errorf("streets: malformed vehicle transfer: %w", err)
+		}
+		return kind, v, true, nil
+	case MessageKindVehicleBatch:
+		var batch []Vehicle
+		if err := m.recvGob(&batch, source, int(kind)); err != nil {
+			return kind, nil, true, fmt.Errorf("streets: malformed vehicle batch: %w", err)
+		}
+		return kind, batch, true, nil
+	case MessageKindVehicleAck:
+		var id string
+		if err := m.recvGob(&id, source, int(kind)); err != nil {
+			return kind, nil, true, fmt.Errorf("streets: malformed vehicle ack: %w", err)
+		}
+		return kind, id, true, nil
+	case MessageKindLoadReport:
+		var report LoadReport
+		if err := m.recvGob(&report, source, int(kind)); err != nil {
+			return kind, nil, true, fmt.Errorf("streets: malformed load report: %w", err)
+		}
+		return kind, report, true, nil
+	case MessageKindSnapshotVehicles:
+		var batch []Vehicle
+		if err := m.recvGob(&batch, source, int(kind)); err != nil {
+			return kind, nil, true, fmt.Errorf("streets: malformed snapshot vehicles: %w", err)
+		}
+		return kind, batch, true, nil
+	case MessageKindShutdown:
+		var empty struct{}
+		_ = m.recvGob(&empty, source, int(kind))
+		return kind, nil, true, nil
+	default:
+		return kind, nil, true, fmt.Errorf("streets: unknown message kind %d from rank %d", kind, source)
+	}
+}
+
+func (m *MPI) broadcastShutdown() {
+	for rank := 0; rank < m.worldSize; rank++ {
+		if rank == m.taskID {
+			continue
+		}
+		m.sendGob(struct{}{}, rank, int(MessageKindShutdown))
+	}
+}
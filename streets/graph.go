@@ -0,0 +1,296 @@
+package streets
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// Vertex is a single intersection/node in the street graph, positioned in
+// geographic space so the graph can be split into rectangular partitions.
+type Vertex struct {
+	ID  int     `json:"id"`
+	Lat float64 `json:"lat"`
+	Lon float64 `json:"lon"`
+}
+
+// Edge is a directed street segment between two vertices.
+type Edge struct {
+	Source int     `json:"source"`
+	Target int     `json:"target"`
+	Length float64 `json:"length"`
+}
+
+// Graph is the in-memory representation of the street network loaded from
+// the JSON export.
+type Graph struct {
+	Vertices map[int]Vertex
+	EdgeList []Edge
+}
+
+// Edges returns all edges in the graph.
+func (g *Graph) Edges() ([]Edge, error) {
+	if g == nil {
+		return nil, fmt.Errorf("graph is nil")
+	}
+	return g.EdgeList, nil
+}
+
+// Size returns the number of vertices in the graph.
+func (g *Graph) Size() (int, error) {
+	if g == nil {
+		return 0, fmt.Errorf("graph is nil")
+	}
+	return len(g.Vertices), nil
+}
+
+// StreetGraph is a (possibly partitioned) view of the street network owned
+// by one MPI rank. The root owns the full graph (ID 0); leaves own the
+// rectangle assigned to them during setup.
+type StreetGraph struct {
+	ID          int
+	Graph       *Graph
+	IsRootGraph bool
+
+	TopRight   Vertex
+	BottomLeft Vertex
+
+	vehicles []*Vehicle
+}
+
+// ApplyReassignment keeps this leaf's local Graph.Vertices in sync with an
+// EdgeReassignment the rebalancer broadcast: source holds the full root
+// graph, which is where the vertex data for a newly-gained ID comes from.
+func (s *StreetGraph) ApplyReassignment(r EdgeReassignment, source *Graph) {
+	if s == nil || s.Graph == nil {
+		return
+	}
+
+	switch s.ID {
+	case r.ToLeaf:
+		if source == nil {
+			return
+		}
+		for _, id := range r.VertexIDs {
+			if v, ok := source.Vertices[id]; ok {
+				s.Graph.Vertices[id] = v
+			}
+		}
+	case r.FromLeaf:
+		for _, id := range r.VertexIDs {
+			delete(s.Graph.Vertices, id)
+		}
+	}
+}
+
+// VertexExists reports whether the given vertex ID is part of this graph.
+func (s *StreetGraph) VertexExists(id int) bool {
+	if s == nil || s.Graph == nil {
+		return false
+	}
+	_, ok := s.Graph.Vertices[id]
+	return ok
+}
+
+type jsonGraph struct {
+	Vertices []Vertex `json:"vertices"`
+	Edges    []Edge   `json:"edges"`
+}
+
+// GraphBuilder assembles a StreetGraph step by step, mirroring the root ->
+// rectangles -> leaf pipeline used by main when it fans work out across MPI
+// ranks.
+type GraphBuilder struct {
+	jsonPath string
+
+	source *Graph
+
+	numberOfRects int
+	rectIdx       int
+
+	isRoot bool
+	isLeaf bool
+
+	rootGraph *StreetGraph
+	taskID    int
+
+	minLat, maxLat float64
+	minLon, maxLon float64
+	rectWidth      float64
+
+	filtered *Graph
+}
+
+// NewGraphBuilder returns an empty GraphBuilder.
+func NewGraphBuilder() *GraphBuilder {
+	return &GraphBuilder{}
+}
+
+// FromJsonFile loads the graph vertices and edges from the JSON file at path.
+func (b *GraphBuilder) FromJsonFile(path string) *GraphBuilder {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		b.source = &Graph{Vertices: map[int]Vertex{}}
+		return b
+	}
+
+	var jg jsonGraph
+	if err := json.Unmarshal(data, &jg); err != nil {
+		b.source = &Graph{Vertices: map[int]Vertex{}}
+		return b
+	}
+
+	g := &Graph{Vertices: make(map[int]Vertex, len(jg.Vertices)), EdgeList: jg.Edges}
+	for _, v := range jg.Vertices {
+		g.Vertices[v.ID] = v
+	}
+	b.source = g
+	return b
+}
+
+// IsRoot marks the graph under construction as the root (unpartitioned)
+// graph.
+func (b *GraphBuilder) IsRoot() *GraphBuilder {
+	b.isRoot = true
+	return b
+}
+
+// IsLeaf marks the graph under construction as a leaf derived from
+// rootGraph, owned by taskID.
+func (b *GraphBuilder) IsLeaf(rootGraph *StreetGraph, taskID int) *GraphBuilder {
+	b.isLeaf = true
+	b.rootGraph = rootGraph
+	b.taskID = taskID
+	return b
+}
+
+// NumberOfRects sets how many rectangles the graph should be divided into.
+func (b *GraphBuilder) NumberOfRects(n int) *GraphBuilder {
+	b.numberOfRects = n
+	return b
+}
+
+// PickRect selects which rectangle (0-indexed) this builder is building for.
+func (b *GraphBuilder) PickRect(i int) *GraphBuilder {
+	b.rectIdx = i
+	return b
+}
+
+// SetTopRightBottomLeftVertices computes the bounding box of the source
+// graph so it can later be sliced into rectangles.
+func (b *GraphBuilder) SetTopRightBottomLeftVertices() *GraphBuilder {
+	if b.source == nil || len(b.source.Vertices) == 0 {
+		return b
+	}
+
+	first := true
+	for _, v := range b.source.Vertices {
+		if first {
+			b.minLat, b.maxLat = v.Lat, v.Lat
+			b.minLon, b.maxLon = v.Lon, v.Lon
+			first = false
+			continue
+		}
+		if v.Lat < b.minLat {
+			b.minLat = v.Lat
+		}
+		if v.Lat > b.maxLat {
+			b.maxLat = v.Lat
+		}
+		if v.Lon < b.minLon {
+			b.minLon = v.Lon
+		}
+		if v.Lon > b.maxLon {
+			b.maxLon = v.Lon
+		}
+	}
+	return b
+}
+
+// DivideGraphsIntoRects splits the source graph's bounding box into
+// b.numberOfRects equal-width vertical strips.
+func (b *GraphBuilder) DivideGraphsIntoRects() *GraphBuilder {
+	n := b.numberOfRects
+	if n < 1 {
+		n = 1
+	}
+	b.rectWidth = (b.maxLon - b.minLon) / float64(n)
+	return b
+}
+
+// rectBounds returns the [left, right) longitude bounds of the currently
+// picked rectangle, widened to include maxLon on the last rectangle so no
+// vertex on the bounding box's edge is dropped by floating point rounding.
+func (b *GraphBuilder) rectBounds() (left, right float64) {
+	left = b.minLon + float64(b.rectIdx)*b.rectWidth
+	right = left + b.rectWidth
+	if b.rectIdx == b.numberOfRects-1 {
+		right = b.maxLon
+	}
+	return left, right
+}
+
+// FilterForRect restricts the graph under construction to the vertices
+// whose longitude falls in [left, right) for the currently picked
+// rectangle ([left, right] for the last one), plus any edge touching one of them (even if its other
+// endpoint belongs to a neighboring rectangle), so a leaf still knows the
+// length of an edge crossing its border.
+func (b *GraphBuilder) FilterForRect() *GraphBuilder {
+	if b.source == nil {
+		return b
+	}
+	if b.rectWidth <= 0 {
+		b.filtered = b.source
+		return b
+	}
+
+	left, right := b.rectBounds()
+	last := b.rectIdx == b.numberOfRects-1
+	filtered := &Graph{Vertices: make(map[int]Vertex)}
+	for id, v := range b.source.Vertices {
+		if v.Lon >= left && (v.Lon < right || (last && v.Lon == right)) {
+			filtered.Vertices[id] = v
+		}
+	}
+
+	for _, e := range b.source.EdgeList {
+		_, srcIn := filtered.Vertices[e.Source]
+		_, dstIn := filtered.Vertices[e.Target]
+		if srcIn || dstIn {
+			filtered.EdgeList = append(filtered.EdgeList, e)
+		}
+	}
+
+	b.filtered = filtered
+	return b
+}
+
+// Build finalizes the StreetGraph from the accumulated builder state.
+func (b *GraphBuilder) Build() (*StreetGraph, error) {
+	g := b.source
+	if b.filtered != nil {
+		g = b.filtered
+	}
+	if g == nil {
+		return nil, fmt.Errorf("streets: no graph source set on builder")
+	}
+
+	id := 0
+	if b.isLeaf {
+		id = b.taskID
+	}
+
+	topRight := Vertex{Lat: b.maxLat, Lon: b.maxLon}
+	bottomLeft := Vertex{Lat: b.minLat, Lon: b.minLon}
+	if b.rectWidth > 0 {
+		bottomLeft.Lon, topRight.Lon = b.rectBounds()
+	}
+
+	return &StreetGraph{
+		ID:          id,
+		Graph:       g,
+		IsRootGraph: b.isRoot,
+		TopRight:    topRight,
+		BottomLeft:  bottomLeft,
+	}, nil
+}
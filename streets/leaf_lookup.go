@@ -0,0 +1,53 @@
+package streets
+
+import "sync"
+
+// LeafLookup maps a vertex ID to the leaf rank that currently owns it. It
+// starts out fixed at setup time, but the rebalancer mutates it whenever it
+// shifts vertices between leaves, and every vehicle transfer reads it, so
+// access goes through a RWMutex instead of a bare map.
+type LeafLookup struct {
+	mu     sync.RWMutex
+	leafOf map[int]int
+}
+
+// NewLeafLookup returns an empty LeafLookup.
+func NewLeafLookup() *LeafLookup {
+	return &LeafLookup{leafOf: make(map[int]int)}
+}
+
+// Set assigns vertexID to leafID.
+func (l *LeafLookup) Set(vertexID, leafID int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.leafOf[vertexID] = leafID
+}
+
+// Get returns the leaf owning vertexID, if any.
+func (l *LeafLookup) Get(vertexID int) (int, bool) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	leaf, ok := l.leafOf[vertexID]
+	return leaf, ok
+}
+
+// Reassign moves every vertex in r.VertexIDs to r.ToLeaf in one atomic step.
+func (l *LeafLookup) Reassign(r EdgeReassignment) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, v := range r.VertexIDs {
+		l.leafOf[v] = r.ToLeaf
+	}
+}
+
+// Snapshot returns a point-in-time copy, so callers like the rebalancer can
+// inspect adjacency without holding the lock for the whole computation.
+func (l *LeafLookup) Snapshot() map[int]int {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	cp := make(map[int]int, len(l.leafOf))
+	for k, v := range l.leafOf {
+		cp[k] = v
+	}
+	return cp
+}
@@ -0,0 +1,67 @@
+package streets
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Metrics are exported in Prometheus text format from main on rank 0. They
+// are package-level (rather than threaded through every call site) because
+// MPI, StreetGraph and Vehicle are constructed in many places across the
+// root/leaf split, and the registry itself is process-global anyway.
+var (
+	VehiclesPerLeaf = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "pchpc",
+		Subsystem: "streets",
+		Name:      "vehicles_per_leaf",
+		Help:      "Number of vehicles currently active on a leaf, keyed by leaf rank.",
+	}, []string{"leaf"})
+
+	EdgeTraversalDelta = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: "pchpc",
+		Subsystem: "streets",
+		Name:      "edge_traversal_delta",
+		Help:      "Distribution of the delta accumulated while a vehicle crosses one edge.",
+		Buckets:   prometheus.DefBuckets,
+	})
+
+	MPIMessagesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "pchpc",
+		Subsystem: "mpi",
+		Name:      "messages_total",
+		Help:      "MPI messages sent or received, keyed by message kind.",
+	}, []string{"kind"})
+
+	ListenerQueueDepth = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "pchpc",
+		Subsystem: "mpi",
+		Name:      "listener_queue_depth",
+		Help:      "Number of requests waiting on a root listener goroutine, keyed by listener.",
+	}, []string{"listener"})
+
+	VehicleStepLatency = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: "pchpc",
+		Subsystem: "streets",
+		Name:      "vehicle_step_latency_seconds",
+		Help:      "Wall-clock latency of a single Vehicle.Step call.",
+		Buckets:   prometheus.DefBuckets,
+	})
+)
+
+const (
+	// MPIMessageEmitVehicle, etc. are the label values used with
+	// MPIMessagesTotal so call sites don't restate the string literal.
+	MPIMessageEmitVehicle       = "EmitVehicle"
+	MPIMessageEdgeLengthRequest = "EdgeLengthRequest"
+	MPIMessageReceiveAndSend    = "ReceiveAndSend"
+	MPIMessageSendVehicleToRoot = "SendVehicleToRoot"
+)
+
+func init() {
+	prometheus.MustRegister(
+		VehiclesPerLeaf,
+		EdgeTraversalDelta,
+		MPIMessagesTotal,
+		ListenerQueueDepth,
+		VehicleStepLatency,
+	)
+}
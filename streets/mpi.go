@@ -0,0 +1,388 @@
+package streets
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"sync"
+	"time"
+
+	mpi "github.com/sbromberger/gompi"
+)
+
+// EdgeLengthRequest is sent from a leaf to the root to ask for the length
+// of the edge between two vertices.
+type EdgeLengthRequest struct {
+	From int
+	To   int
+	Rank int
+}
+
+// transport is the subset of gompi's Communicator that MPI drives messages
+// through, extracted so tests can swap in an in-process fake instead of
+// requiring a real MPI environment.
+type transport interface {
+	sendBytes(payload []byte, dest, tag int)
+	recvBytes(source, tag int) []byte
+	iprobe(source, tag int) (available bool, from, tag2 int)
+	barrier()
+}
+
+// commTransport is the transport backed by a real gompi.Communicator.
+type commTransport struct{ comm mpi.Communicator }
+
+func (c commTransport) sendBytes(payload []byte, dest, tag int) {
+	c.comm.Send[byte](payload, dest, tag)
+}
+
+func (c commTransport) recvBytes(source, tag int) []byte {
+	data, _ := c.comm.Recv[byte](source, tag)
+	return data
+}
+
+func (c commTransport) iprobe(source, tag int) (bool, int, int) {
+	available, status := c.comm.Iprobe(source, tag)
+	if !available {
+		return false, 0, 0
+	}
+	return true, status.Source(), status.Tag()
+}
+
+func (c commTransport) barrier() { c.comm.Barrier() }
+
+// MPI wraps a gompi Communicator with the message shapes this simulation
+// sends between root and leaves.
+type MPI struct {
+	taskID    int
+	worldSize int
+	comm      transport
+	root      *StreetGraph
+
+	batchSize    int
+	batchTimeout time.Duration
+	buffersMu    sync.Mutex
+	buffers      map[int]*TransferBuffer
+
+	pending chan Vehicle
+
+	snapshotProvider func() []Vehicle
+}
+
+// NewMPI returns an MPI helper bound to the given rank's communicator and
+// the root's (unpartitioned) graph, which is needed to answer edge length
+// requests. worldSize is the total number of ranks, used to broadcast to
+// every other rank without a package-level lookup.
+func NewMPI(taskID int, comm mpi.Communicator, root *StreetGraph, worldSize int) *MPI {
+	return newMPI(taskID, commTransport{comm: comm}, root, worldSize)
+}
+
+// newMPI is the shared constructor behind NewMPI, taking a transport
+// directly so tests can pass an in-process fake instead of a real
+// gompi.Communicator.
+func newMPI(taskID int, t transport, root *StreetGraph, worldSize int) *MPI {
+	return &MPI{
+		taskID:       taskID,
+		worldSize:    worldSize,
+		comm:         t,
+		root:         root,
+		batchSize:    DefaultMPIBatchSize,
+		batchTimeout: DefaultMPIBatchTimeout,
+		buffers:      make(map[int]*TransferBuffer),
+		pending:      make(chan Vehicle, DefaultMPIBatchSize*4),
+	}
+}
+
+// SetBatchOptions overrides the default vehicle-transfer batch size and
+// flush deadline, e.g. from the -mpi-batch-size / -mpi-batch-timeout flags.
+// It also resizes m.pending to fit the new batch size, since a batch larger
+// than its old capacity would otherwise deadlock ReceiveVehicleOnLeaf
+// draining it one vehicle at a time into a full channel. Callers set batch
+// options right after NewMPI, before any vehicle has arrived, so there is
+// nothing already queued in the old channel to carry over.
+func (m *MPI) SetBatchOptions(batchSize int, timeout time.Duration) {
+	m.batchSize = batchSize
+	m.batchTimeout = timeout
+	m.pending = make(chan Vehicle, batchSize*4)
+}
+
+// SetSnapshotProvider registers the function ReceiveVehicleOnLeaf calls to
+// get this leaf's currently in-flight vehicles when it receives a
+// SnapshotRequest, so the leaf-side vehicle registry can live in whatever
+// package drives the leaf's receive loop instead of here.
+func (m *MPI) SetSnapshotProvider(fn func() []Vehicle) {
+	m.snapshotProvider = fn
+}
+
+// sendGob gob-encodes payload and sends it over the transport's byte
+// primitive. Every payload type sent through this package is a plain
+// exported-field struct or slice thereof, so encoding cannot fail in
+// practice.
+func (m *MPI) sendGob(payload interface{}, dest, tag int) {
+	var buf bytes.Buffer
+	_ = gob.NewEncoder(&buf).Encode(payload)
+	m.comm.sendBytes(buf.Bytes(), dest, tag)
+}
+
+// recvGob receives bytes from the transport and gob-decodes them into dest,
+// the mirror of sendGob on the receiving end.
+func (m *MPI) recvGob(dest interface{}, source, tag int) error {
+	data := m.comm.recvBytes(source, tag)
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(dest)
+}
+
+// bufferFor returns the TransferBuffer accumulating vehicles bound for
+// dest, creating it on first use.
+func (m *MPI) bufferFor(dest int) *TransferBuffer {
+	m.buffersMu.Lock()
+	defer m.buffersMu.Unlock()
+
+	b, ok := m.buffers[dest]
+	if !ok {
+		b = NewTransferBuffer(dest, m.batchSize, m.batchTimeout, m.sendVehicleBatch)
+		m.buffers[dest] = b
+	}
+	return b
+}
+
+func (m *MPI) sendVehicleBatch(dest int, batch []Vehicle) {
+	m.sendGob(batch, dest, int(MessageKindVehicleBatch))
+}
+
+// FlushAll flushes every per-destination TransferBuffer immediately,
+// instead of waiting for it to fill up or hit its deadline. Called before
+// shutdown so no vehicle is left stranded in a buffer.
+func (m *MPI) FlushAll() {
+	m.buffersMu.Lock()
+	buffers := make([]*TransferBuffer, 0, len(m.buffers))
+	for _, b := range m.buffers {
+		buffers = append(buffers, b)
+	}
+	m.buffersMu.Unlock()
+
+	for _, b := range buffers {
+		b.Flush()
+	}
+}
+
+// EmitVehicle queues a freshly created vehicle for delivery to the leaf
+// that owns its starting vertex, according to lookup. The send is batched
+// with other vehicles bound for the same leaf; see TransferBuffer. The
+// batch may also carry ForwardVehicle traffic bound for the same
+// destination, so this counts itself against MPIMessagesTotal
+// here rather than in the shared flush callback, which has no way to tell
+// the kinds apart once they're merged into one batch.
+func (m *MPI) EmitVehicle(v Vehicle, lookup *LeafLookup) error {
+	dest, ok := lookup.Get(v.PrevID)
+	if !ok {
+		return fmt.Errorf("streets: no leaf owns vertex %d", v.PrevID)
+	}
+
+	m.bufferFor(dest).Add(v)
+	MPIMessagesTotal.WithLabelValues(MPIMessageEmitVehicle).Inc()
+	return nil
+}
+
+// EmitVehicles queues a whole batch of freshly created vehicles, grouped by
+// destination leaf. It calls EmitVehicle for each vehicle and then flushes
+// every TransferBuffer, so the last partial batch goes out at once instead
+// of waiting for its deadline. A buffer can still flush on its deadline or
+// size threshold while the loop is running.
+func (m *MPI) EmitVehicles(vehicles []Vehicle, lookup *LeafLookup) error {
+	for _, v := range vehicles {
+		if err := m.EmitVehicle(v, lookup); err != nil {
+			return err
+		}
+	}
+	m.FlushAll()
+	return nil
+}
+
+// ReceiveVehicleOnLeaf blocks until a vehicle is transferred to this leaf or
+// the root broadcasts Shutdown, whichever comes first. Vehicles that
+// arrived as part of a batch are drained into m.pending and handed out one
+// at a time on subsequent calls. Along the way it also applies any
+// EdgeReassignment it observes to leaf and lookup, so the partition stays
+// current without the caller having to poll for it separately.
+func (m *MPI) ReceiveVehicleOnLeaf(leaf *StreetGraph, lookup *LeafLookup) (Vehicle, bool, error) {
+	select {
+	case v := <-m.pending:
+		return v, false, nil
+	default:
+	}
+
+	for {
+		available, source, tag := m.comm.iprobe(mpi.AnySource, mpi.AnyTag)
+		if !available {
+			time.Sleep(time.Millisecond)
+			continue
+		}
+
+		switch MessageKind(tag) {
+		case MessageKindShutdown:
+			var empty struct{}
+			_ = m.recvGob(&empty, source, int(MessageKindShutdown))
+			return Vehicle{}, true, nil
+		case MessageKindVehicleTransfer:
+			var v Vehicle
+			if err := m.recvGob(&v, source, int(MessageKindVehicleTransfer)); err != nil {
+				return Vehicle{}, false, fmt.Errorf("streets: received malformed vehicle transfer: %w", err)
+			}
+			return v, false, nil
+		case MessageKindVehicleBatch:
+			var batch []Vehicle
+			if err := m.recvGob(&batch, source, int(MessageKindVehicleBatch)); err != nil {
+				return Vehicle{}, false, fmt.Errorf("streets: received malformed vehicle batch: %w", err)
+			}
+			if len(batch) == 0 {
+				return Vehicle{}, false, fmt.Errorf("streets: received empty vehicle batch")
+			}
+			for _, v := range batch[1:] {
+				m.pending <- v
+			}
+			return batch[0], false, nil
+		case MessageKindEdgeReassignment:
+			var r EdgeReassignment
+			if err := m.recvGob(&r, source, int(MessageKindEdgeReassignment)); err == nil {
+				lookup.Reassign(r)
+				leaf.ApplyReassignment(r, m.root.Graph)
+			}
+			continue
+		case MessageKindSnapshotRequest:
+			var empty struct{}
+			_ = m.recvGob(&empty, source, int(MessageKindSnapshotRequest))
+			m.FlushAll()
+			if m.snapshotProvider != nil {
+				if err := m.SendSnapshotVehicles(m.snapshotProvider()); err != nil {
+					return Vehicle{}, false, err
+				}
+			}
+			m.comm.barrier()
+			continue
+		default:
+			continue
+		}
+	}
+}
+
+// SendVehicleToRoot queues a vehicle that left this leaf's rectangle for
+// delivery back to root, batched with other vehicles leaving on the same
+// tick.
+func (m *MPI) SendVehicleToRoot(v Vehicle) error {
+	m.bufferFor(0).Add(v)
+	MPIMessagesTotal.WithLabelValues(MPIMessageSendVehicleToRoot).Inc()
+	return nil
+}
+
+// AckVehicleParked tells root that a vehicle finished its route on this
+// leaf, so root can tell when the simulation is done and broadcast
+// Shutdown.
+func (m *MPI) AckVehicleParked(vehicleID string) error {
+	m.sendGob(vehicleID, 0, int(MessageKindVehicleAck))
+	return nil
+}
+
+// AskRootForEdgeLength asks the root for the length of the edge (from, to)
+// and blocks for the response.
+func (m *MPI) AskRootForEdgeLength(from, to int) (float64, error) {
+	m.sendGob(EdgeLengthRequest{From: from, To: to, Rank: m.taskID}, 0, int(MessageKindEdgeLengthReq))
+
+	var length float64
+	if err := m.recvGob(&length, 0, int(MessageKindEdgeLengthResp)); err != nil {
+		return 0, fmt.Errorf("streets: received malformed edge length response: %w", err)
+	}
+	MPIMessagesTotal.WithLabelValues(MPIMessageEdgeLengthRequest).Inc()
+	return length, nil
+}
+
+// RespondToEdgeLength answers one edge length request, addressed to the
+// rank that asked. It is registered as the root's MessageKindEdgeLengthReq
+// Handler rather than called from a blocking polling loop.
+func (m *MPI) RespondToEdgeLength(req EdgeLengthRequest) error {
+	length := m.lookupEdgeLength(req.From, req.To)
+	m.sendGob(length, req.Rank, int(MessageKindEdgeLengthResp))
+	return nil
+}
+
+// ForwardVehicle queues a vehicle received from a leaf for delivery onward
+// to whichever leaf owns its next vertex. It is registered as the root's
+// MessageKindVehicleTransfer and MessageKindVehicleBatch Handler.
+func (m *MPI) ForwardVehicle(v Vehicle, lookup *LeafLookup) error {
+	dest, ok := lookup.Get(v.NextID)
+	if !ok {
+		return fmt.Errorf("streets: no leaf owns vertex %d", v.NextID)
+	}
+
+	m.bufferFor(dest).Add(v)
+	MPIMessagesTotal.WithLabelValues(MPIMessageReceiveAndSend).Inc()
+	return nil
+}
+
+// ForwardVehicles is ForwardVehicle for an already-decoded batch, used when
+// the root's MessageKindVehicleBatch Handler fires.
+func (m *MPI) ForwardVehicles(batch []Vehicle, lookup *LeafLookup) error {
+	for _, v := range batch {
+		if err := m.ForwardVehicle(v, lookup); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SendLoadReport tells root how busy this leaf currently is, so root's
+// Rebalancer can decide whether the partition has become imbalanced.
+func (m *MPI) SendLoadReport(report LoadReport) error {
+	m.sendGob(report, 0, int(MessageKindLoadReport))
+	return nil
+}
+
+// BroadcastEdgeReassignment tells every rank that the vertices in r moved
+// leaves, so every rank's LeafLookup stays consistent after a rebalance.
+func (m *MPI) BroadcastEdgeReassignment(r EdgeReassignment) {
+	for rank := 0; rank < m.worldSize; rank++ {
+		if rank == m.taskID {
+			continue
+		}
+		m.sendGob(r, rank, int(MessageKindEdgeReassignment))
+	}
+}
+
+// BroadcastSnapshotRequest asks every other rank to flush its pending
+// transfer buffers, report its in-flight vehicles and wait at a barrier, so
+// a Snapshot root takes afterward reflects a consistent point in time
+// instead of vehicles caught mid-transfer.
+func (m *MPI) BroadcastSnapshotRequest() {
+	for rank := 0; rank < m.worldSize; rank++ {
+		if rank == m.taskID {
+			continue
+		}
+		m.sendGob(struct{}{}, rank, int(MessageKindSnapshotRequest))
+	}
+}
+
+// SendSnapshotVehicles reports this leaf's currently in-flight vehicles to
+// root, in response to a SnapshotRequest.
+func (m *MPI) SendSnapshotVehicles(vehicles []Vehicle) error {
+	m.sendGob(vehicles, 0, int(MessageKindSnapshotVehicles))
+	return nil
+}
+
+// AwaitSnapshotBarrier blocks until every rank has reached this call. Root
+// calls it once it has collected every leaf's SnapshotVehicles reply; each
+// leaf reaches the same barrier inside ReceiveVehicleOnLeaf right after
+// sending its own, so nobody writes or resumes
+// from a Snapshot until the whole run has quiesced together.
+func (m *MPI) AwaitSnapshotBarrier() {
+	m.comm.barrier()
+}
+
+func (m *MPI) lookupEdgeLength(from, to int) float64 {
+	if m.root == nil || m.root.Graph == nil {
+		return 0
+	}
+	for _, e := range m.root.Graph.EdgeList {
+		if e.Source == from && e.Target == to {
+			return e.Length
+		}
+	}
+	return 0
+}
@@ -0,0 +1,187 @@
+package streets
+
+import "sync"
+
+// LoadReport is sent periodically from a leaf to root describing how busy
+// it currently is, so root can detect an imbalanced partition.
+type LoadReport struct {
+	LeafID       int
+	VehicleCount int
+	AvgStepTime  float64 // seconds
+}
+
+// EdgeReassignment tells every rank that the vertices in VertexIDs now
+// belong to ToLeaf instead of FromLeaf.
+type EdgeReassignment struct {
+	FromLeaf  int
+	ToLeaf    int
+	VertexIDs []int
+}
+
+// DefaultRebalanceRatio is the max/min EWMA load ratio above which root
+// shifts edges from the heaviest leaf to its lightest neighbor.
+const DefaultRebalanceRatio = 2.0
+
+// loadTracker maintains an exponentially weighted moving average of each
+// leaf's vehicle count, so a single noisy report doesn't trigger a
+// rebalance on its own.
+type loadTracker struct {
+	mu    sync.Mutex
+	alpha float64
+	ewma  map[int]float64
+}
+
+func newLoadTracker(alpha float64) *loadTracker {
+	return &loadTracker{alpha: alpha, ewma: make(map[int]float64)}
+}
+
+func (t *loadTracker) report(leafID, vehicleCount int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	v := float64(vehicleCount)
+	if cur, ok := t.ewma[leafID]; ok {
+		t.ewma[leafID] = t.alpha*v + (1-t.alpha)*cur
+	} else {
+		t.ewma[leafID] = v
+	}
+}
+
+func (t *loadTracker) load(leafID int) float64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.ewma[leafID]
+}
+
+func (t *loadTracker) heaviest() (leafID int, ok bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	first := true
+	var maxLoad float64
+	for leaf, load := range t.ewma {
+		if first || load > maxLoad {
+			leafID, maxLoad = leaf, load
+			first = false
+		}
+	}
+	return leafID, !first
+}
+
+// Rebalancer watches per-leaf load and, once the heaviest leaf outgrows its
+// lightest neighbor by more than Ratio, plans an EdgeReassignment moving
+// vertices between them.
+type Rebalancer struct {
+	tracker *loadTracker
+	Ratio   float64
+}
+
+// NewRebalancer returns a Rebalancer that triggers once the heaviest leaf's
+// EWMA load exceeds its lightest neighbor's by more than ratio.
+func NewRebalancer(ratio float64) *Rebalancer {
+	return &Rebalancer{tracker: newLoadTracker(0.3), Ratio: ratio}
+}
+
+// Report feeds one leaf's LoadReport into the tracker.
+func (r *Rebalancer) Report(report LoadReport) {
+	r.tracker.report(report.LeafID, report.VehicleCount)
+}
+
+// Plan inspects the current EWMA loads and, if the heaviest leaf is
+// imbalanced relative to one of its graph-adjacent neighbors, returns an
+// EdgeReassignment moving the vertices on the shared border to the
+// lightest such neighbor. ok is false when no rebalance is warranted.
+func (r *Rebalancer) Plan(root *StreetGraph, lookup *LeafLookup) (EdgeReassignment, bool) {
+	heaviest, ok := r.tracker.heaviest()
+	if !ok {
+		return EdgeReassignment{}, false
+	}
+
+	snapshot := lookup.Snapshot()
+	neighbors := neighborLeaves(root, snapshot, heaviest)
+	if len(neighbors) == 0 {
+		return EdgeReassignment{}, false
+	}
+
+	lightest := neighbors[0]
+	for _, n := range neighbors[1:] {
+		if r.tracker.load(n) < r.tracker.load(lightest) {
+			lightest = n
+		}
+	}
+
+	if r.tracker.load(lightest) <= 0 {
+		if r.tracker.load(heaviest) <= 0 {
+			return EdgeReassignment{}, false
+		}
+	} else if r.tracker.load(heaviest)/r.tracker.load(lightest) <= r.Ratio {
+		return EdgeReassignment{}, false
+	}
+
+	vertices := borderVertices(root, snapshot, heaviest, lightest)
+	if len(vertices) == 0 {
+		return EdgeReassignment{}, false
+	}
+
+	return EdgeReassignment{FromLeaf: heaviest, ToLeaf: lightest, VertexIDs: vertices}, true
+}
+
+// neighborLeaves returns the distinct leaves adjacent to leafID: every leaf
+// that owns the other endpoint of an edge with one endpoint on leafID.
+func neighborLeaves(root *StreetGraph, lookup map[int]int, leafID int) []int {
+	if root == nil || root.Graph == nil {
+		return nil
+	}
+
+	seen := make(map[int]bool)
+	var neighbors []int
+	for _, e := range root.Graph.EdgeList {
+		srcLeaf, srcOK := lookup[e.Source]
+		dstLeaf, dstOK := lookup[e.Target]
+		if !srcOK || !dstOK || srcLeaf == dstLeaf {
+			continue
+		}
+		if srcLeaf == leafID && !seen[dstLeaf] {
+			seen[dstLeaf] = true
+			neighbors = append(neighbors, dstLeaf)
+		}
+		if dstLeaf == leafID && !seen[srcLeaf] {
+			seen[srcLeaf] = true
+			neighbors = append(neighbors, srcLeaf)
+		}
+	}
+	return neighbors
+}
+
+// borderVertices returns the vertices currently owned by fromLeaf that sit
+// directly across an edge from a vertex owned by toLeaf — the minimal set
+// that can move without disconnecting the rest of fromLeaf's rectangle.
+func borderVertices(root *StreetGraph, lookup map[int]int, fromLeaf, toLeaf int) []int {
+	if root == nil || root.Graph == nil {
+		return nil
+	}
+
+	seen := make(map[int]bool)
+	var vertices []int
+	add := func(id int) {
+		if !seen[id] {
+			seen[id] = true
+			vertices = append(vertices, id)
+		}
+	}
+
+	for _, e := range root.Graph.EdgeList {
+		srcLeaf, srcOK := lookup[e.Source]
+		dstLeaf, dstOK := lookup[e.Target]
+		if !srcOK || !dstOK {
+			continue
+		}
+		if srcLeaf == fromLeaf && dstLeaf == toLeaf {
+			add(e.Source)
+		}
+		if dstLeaf == fromLeaf && srcLeaf == toLeaf {
+			add(e.Target)
+		}
+	}
+	return vertices
+}
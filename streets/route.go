@@ -0,0 +1,97 @@
+package streets
+
+import (
+	"container/heap"
+	"fmt"
+)
+
+// CongestionReplanThreshold is the edge Delta (same units as Edge.Length)
+// above which a leaf should call Vehicle.Replan instead of driving the
+// vehicle down its existing route unchanged.
+const CongestionReplanThreshold = 500.0
+
+// pqItem is one entry in the Dijkstra priority queue: a candidate vertex and
+// its tentative distance from the search's source.
+type pqItem struct {
+	vertex int
+	dist   float64
+}
+
+// priorityQueue is a container/heap min-heap of pqItem ordered by dist.
+type priorityQueue []pqItem
+
+func (pq priorityQueue) Len() int            { return len(pq) }
+func (pq priorityQueue) Less(i, j int) bool  { return pq[i].dist < pq[j].dist }
+func (pq priorityQueue) Swap(i, j int)       { pq[i], pq[j] = pq[j], pq[i] }
+func (pq *priorityQueue) Push(x interface{}) { *pq = append(*pq, x.(pqItem)) }
+func (pq *priorityQueue) Pop() interface{} {
+	old := *pq
+	n := len(old)
+	item := old[n-1]
+	*pq = old[:n-1]
+	return item
+}
+
+// ShortestPath computes the least-cost vertex sequence from src to dst using
+// Dijkstra's algorithm, weighted by Edge.Length. It maintains a min-heap of
+// (dist, vertex) pairs, popping the lowest each iteration and relaxing its
+// outgoing edges, and stops as soon as dst itself is popped. The returned
+// path includes both src and dst; an error means dst is unreachable from
+// src.
+func (s *StreetGraph) ShortestPath(src, dst int) ([]int, float64, error) {
+	if s == nil || s.Graph == nil {
+		return nil, 0, fmt.Errorf("streets: nil graph")
+	}
+	if src == dst {
+		return []int{src}, 0, nil
+	}
+
+	adj := make(map[int][]Edge, len(s.Graph.EdgeList))
+	for _, e := range s.Graph.EdgeList {
+		adj[e.Source] = append(adj[e.Source], e)
+	}
+
+	dist := map[int]float64{src: 0}
+	pred := make(map[int]int)
+	visited := make(map[int]bool)
+
+	pq := &priorityQueue{{vertex: src, dist: 0}}
+	for pq.Len() > 0 {
+		cur := heap.Pop(pq).(pqItem)
+		if visited[cur.vertex] {
+			continue
+		}
+		visited[cur.vertex] = true
+		if cur.vertex == dst {
+			break
+		}
+
+		for _, e := range adj[cur.vertex] {
+			nd := cur.dist + e.Length
+			if d, ok := dist[e.Target]; !ok || nd < d {
+				dist[e.Target] = nd
+				pred[e.Target] = cur.vertex
+				heap.Push(pq, pqItem{vertex: e.Target, dist: nd})
+			}
+		}
+	}
+
+	if !visited[dst] {
+		return nil, 0, fmt.Errorf("streets: no path from %d to %d", src, dst)
+	}
+
+	path := []int{dst}
+	for v := dst; v != src; {
+		p, ok := pred[v]
+		if !ok {
+			return nil, 0, fmt.Errorf("streets: no path from %d to %d", src, dst)
+		}
+		path = append(path, p)
+		v = p
+	}
+	for i, j := 0, len(path)-1; i < j; i, j = i+1, j-1 {
+		path[i], path[j] = path[j], path[i]
+	}
+
+	return path, dist[dst], nil
+}
@@ -0,0 +1,133 @@
+package streets
+
+import (
+	"encoding/json"
+	"os"
+	"reflect"
+	"testing"
+)
+
+// synthetic graph:
+//
+//	1 --5--> 2 --1--> 4
+//	1 --1--> 3 --1--> 4
+//
+// shortest path 1 -> 4 is via 3 (cost 2), not via 2 (cost 6).
+func synthGraph() *StreetGraph {
+	g := &Graph{
+		Vertices: map[int]Vertex{
+			1: {ID: 1},
+			2: {ID: 2},
+			3: {ID: 3},
+			4: {ID: 4},
+		},
+		EdgeList: []Edge{
+			{Source: 1, Target: 2, Length: 5},
+			{Source: 2, Target: 4, Length: 1},
+			{Source: 1, Target: 3, Length: 1},
+			{Source: 3, Target: 4, Length: 1},
+		},
+	}
+	return &StreetGraph{ID: 0, Graph: g, IsRootGraph: true}
+}
+
+func TestShortestPathPicksCheaperRoute(t *testing.T) {
+	s := synthGraph()
+
+	path, length, err := s.ShortestPath(1, 4)
+	if err != nil {
+		t.Fatalf("ShortestPath returned error: %v", err)
+	}
+
+	want := []int{1, 3, 4}
+	if !reflect.DeepEqual(path, want) {
+		t.Errorf("path = %v, want %v", path, want)
+	}
+	if length != 2 {
+		t.Errorf("length = %v, want 2", length)
+	}
+}
+
+func TestShortestPathSameVertex(t *testing.T) {
+	s := synthGraph()
+
+	path, length, err := s.ShortestPath(1, 1)
+	if err != nil {
+		t.Fatalf("ShortestPath returned error: %v", err)
+	}
+	if !reflect.DeepEqual(path, []int{1}) {
+		t.Errorf("path = %v, want [1]", path)
+	}
+	if length != 0 {
+		t.Errorf("length = %v, want 0", length)
+	}
+}
+
+func TestShortestPathUnreachable(t *testing.T) {
+	s := synthGraph()
+	s.Graph.Vertices[5] = Vertex{ID: 5}
+
+	if _, _, err := s.ShortestPath(1, 5); err == nil {
+		t.Error("expected an error for an unreachable destination, got nil")
+	}
+}
+
+func TestVehicleFollowsPlannedRoute(t *testing.T) {
+	s := synthGraph()
+
+	v, err := s.AddVehicle(1, 1, 1, 4)
+	if err != nil {
+		t.Fatalf("AddVehicle returned error: %v", err)
+	}
+
+	want := []int{1, 3, 4}
+	if !reflect.DeepEqual(v.Route, want) {
+		t.Fatalf("v.Route = %v, want %v", v.Route, want)
+	}
+	if v.PrevID != 1 || v.NextID != 3 {
+		t.Fatalf("v.PrevID, v.NextID = %d, %d, want 1, 3", v.PrevID, v.NextID)
+	}
+
+	if next := v.GetNextID(v.NextID); next != 4 {
+		t.Errorf("GetNextID(3) = %d, want 4", next)
+	}
+}
+
+func loadBenchGraph(b *testing.B) *StreetGraph {
+	b.Helper()
+	data, err := os.ReadFile("../assets/out.json")
+	if err != nil {
+		b.Skipf("assets/out.json not available: %v", err)
+	}
+
+	var jg struct {
+		Vertices []Vertex `json:"vertices"`
+		Edges    []Edge   `json:"edges"`
+	}
+	if err := json.Unmarshal(data, &jg); err != nil {
+		b.Skipf("assets/out.json not parseable: %v", err)
+	}
+
+	g := &Graph{Vertices: make(map[int]Vertex, len(jg.Vertices)), EdgeList: jg.Edges}
+	for _, v := range jg.Vertices {
+		g.Vertices[v.ID] = v
+	}
+	return &StreetGraph{ID: 0, Graph: g, IsRootGraph: true}
+}
+
+func BenchmarkShortestPath(b *testing.B) {
+	s := loadBenchGraph(b)
+
+	ids := make([]int, 0, len(s.Graph.Vertices))
+	for id := range s.Graph.Vertices {
+		ids = append(ids, id)
+	}
+	if len(ids) < 2 {
+		b.Skip("not enough vertices in assets/out.json to benchmark")
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, _, _ = s.ShortestPath(ids[0], ids[len(ids)-1])
+	}
+}
@@ -0,0 +1,85 @@
+package streets
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"os"
+)
+
+// SnapshotVersion is bumped whenever the on-disk Snapshot format changes in
+// an incompatible way, so Restore can reject a file it no longer
+// understands instead of silently misreading it.
+const SnapshotVersion = 1
+
+// Snapshot is the full serializable simulation state needed to resume a run
+// exactly where it left off: every Vehicle, the leaf lookup routing table,
+// and the RNG seed AddVehicle's random choices were drawn from.
+type Snapshot struct {
+	Version  int
+	Seed     int64
+	Vehicles []Vehicle
+	LeafOf   map[int]int
+}
+
+// WriteSnapshot gob-encodes vehicles, leafOf and seed to path.
+func WriteSnapshot(path string, vehicles []Vehicle, leafOf map[int]int, seed int64) error {
+	snap := Snapshot{
+		Version:  SnapshotVersion,
+		Seed:     seed,
+		Vehicles: vehicles,
+		LeafOf:   leafOf,
+	}
+
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(snap); err != nil {
+		return fmt.Errorf("streets: encode snapshot: %w", err)
+	}
+	if err := os.WriteFile(path, buf.Bytes(), 0o644); err != nil {
+		return fmt.Errorf("streets: write snapshot: %w", err)
+	}
+	return nil
+}
+
+// Restore reads the Snapshot written at path and returns its vehicles and
+// leaf lookup table, ready to resume a run from. The vehicles are not yet
+// attached to a StreetGraph; the caller does that once it knows which graph
+// each one belongs to.
+func Restore(path string) ([]*Vehicle, map[int]int, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("streets: read snapshot: %w", err)
+	}
+
+	var snap Snapshot
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&snap); err != nil {
+		return nil, nil, fmt.Errorf("streets: decode snapshot: %w", err)
+	}
+	if snap.Version != SnapshotVersion {
+		return nil, nil, fmt.Errorf("streets: snapshot version %d unsupported (want %d)", snap.Version, SnapshotVersion)
+	}
+
+	vehicles := make([]*Vehicle, len(snap.Vehicles))
+	for i := range snap.Vehicles {
+		v := snap.Vehicles[i]
+		vehicles[i] = &v
+	}
+	return vehicles, snap.LeafOf, nil
+}
+
+// RestoreSeed reads the Snapshot at path like Restore but returns only the
+// RNG seed the run was started with. Re-seeding math/rand with it replays
+// the original run's random choices from their beginning; the generator's
+// position at the time the snapshot was written is not recorded.
+func RestoreSeed(path string) (int64, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, fmt.Errorf("streets: read snapshot: %w", err)
+	}
+
+	var snap Snapshot
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&snap); err != nil {
+		return 0, fmt.Errorf("streets: decode snapshot: %w", err)
+	}
+	return snap.Seed, nil
+}
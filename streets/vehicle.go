@@ -0,0 +1,160 @@
+package streets
+
+import (
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Vehicle is a single simulated car moving along the StreetGraph it is
+// currently attached to.
+type Vehicle struct {
+	ID string
+
+	StreetGraph *StreetGraph
+
+	PrevID int
+	NextID int
+	Delta  float64
+
+	Speed float64
+
+	// Route is the planned vertex sequence from ShortestPath, consulted by
+	// GetNextID in preference to an arbitrary outgoing edge. Empty for
+	// vehicles created without an (origin, destination) pair, which keep
+	// the old pick-whatever-edge-comes-next behavior.
+	Route       []int
+	RouteIdx    int
+	Destination int
+
+	IsParked          bool
+	MarkedForDeletion bool
+}
+
+// AddVehicle creates a new Vehicle on the graph with a random speed in
+// [minSpeed, maxSpeed] and attaches it to the graph's vehicle list. With no
+// further arguments its starting edge is picked at random, as before. Given
+// exactly two further ints (origin, destination), its route is planned with
+// ShortestPath instead.
+func (s *StreetGraph) AddVehicle(minSpeed, maxSpeed float64, route ...int) (*Vehicle, error) {
+	if s == nil || s.Graph == nil || len(s.Graph.Vertices) == 0 {
+		return nil, fmt.Errorf("streets: cannot add vehicle to empty graph")
+	}
+	if len(route) != 0 && len(route) != 2 {
+		return nil, fmt.Errorf("streets: AddVehicle takes either no route args or exactly (origin, destination)")
+	}
+
+	v := &Vehicle{
+		ID:          uuid.NewString(),
+		StreetGraph: s,
+		Speed:       minSpeed + rand.Float64()*(maxSpeed-minSpeed),
+	}
+
+	if len(route) == 2 {
+		origin, destination := route[0], route[1]
+		path, _, err := s.ShortestPath(origin, destination)
+		if err != nil {
+			return nil, err
+		}
+		v.Route = path
+		v.Destination = destination
+		v.PrevID = path[0]
+		v.NextID = path[0]
+		if len(path) > 1 {
+			v.NextID = path[1]
+		}
+	} else {
+		ids := make([]int, 0, len(s.Graph.Vertices))
+		for id := range s.Graph.Vertices {
+			ids = append(ids, id)
+		}
+
+		prev := ids[rand.Intn(len(ids))]
+		next := prev
+		for next == prev && len(ids) > 1 {
+			next = ids[rand.Intn(len(ids))]
+		}
+		v.PrevID = prev
+		v.NextID = next
+	}
+
+	s.vehicles = append(s.vehicles, v)
+	return v, nil
+}
+
+// GetNextID returns the vertex that follows prevID in the vehicle's route.
+// A vehicle with a planned Route follows it; otherwise it falls back to
+// whatever outgoing edge its current StreetGraph offers for prevID, which is
+// also the fallback taken when prevID has fallen off the end of Route (e.g.
+// a leaf transition handed the vehicle a vertex the plan didn't anticipate).
+func (v *Vehicle) GetNextID(prevID int) int {
+	for i := v.RouteIdx; i < len(v.Route); i++ {
+		if v.Route[i] != prevID {
+			continue
+		}
+		v.RouteIdx = i
+		if i+1 < len(v.Route) {
+			return v.Route[i+1]
+		}
+		return prevID
+	}
+
+	if v.StreetGraph == nil || v.StreetGraph.Graph == nil {
+		return prevID
+	}
+
+	for _, e := range v.StreetGraph.Graph.EdgeList {
+		if e.Source == prevID {
+			return e.Target
+		}
+	}
+	return prevID
+}
+
+// Replan recomputes this vehicle's remaining route from its current position
+// to Destination, discarding the rest of the old one. Leaves call this when
+// an edge's Delta comes back above CongestionReplanThreshold, so a routed
+// vehicle can route around newly-congested edges instead of driving through
+// them regardless. It is a no-op for vehicles that have no planned route.
+func (v *Vehicle) Replan(root *StreetGraph) error {
+	if len(v.Route) == 0 {
+		return nil
+	}
+
+	path, _, err := root.ShortestPath(v.PrevID, v.Destination)
+	if err != nil {
+		return err
+	}
+	v.Route = path
+	v.RouteIdx = 0
+	return nil
+}
+
+// Step advances the vehicle by one tick: it accumulates delta towards the
+// next vertex and parks once it arrives.
+func (v *Vehicle) Step() {
+	start := time.Now()
+	defer func() {
+		VehicleStepLatency.Observe(time.Since(start).Seconds())
+	}()
+
+	v.Delta -= v.Speed
+	if v.Delta <= 0 {
+		EdgeTraversalDelta.Observe(v.Delta)
+		v.PrevID = v.NextID
+		v.NextID = v.GetNextID(v.PrevID)
+		if v.NextID == v.PrevID {
+			v.IsParked = true
+		}
+	}
+}
+
+// Drive runs the vehicle to completion in the current goroutine. Used by
+// the non-MPI single-process mode.
+func (v *Vehicle) Drive() {
+	for !v.IsParked {
+		v.Step()
+	}
+}